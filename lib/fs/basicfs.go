@@ -0,0 +1,117 @@
+// Copyright (C) 2016 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package fs
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// BasicFilesystem is a Filesystem implementation that uses the local disk
+// directly, rooted at a given directory.
+type BasicFilesystem struct {
+	root string
+}
+
+func newBasicFilesystem(root string) *BasicFilesystem {
+	return &BasicFilesystem{root: filepath.Clean(root)}
+}
+
+// rooted returns the absolute path for name, which must be relative to the
+// filesystem root. It refuses to resolve outside of the root.
+func (f *BasicFilesystem) rooted(name string) (string, error) {
+	joined := filepath.Join(f.root, name)
+	if joined != f.root && !strings.HasPrefix(joined, f.root+string(os.PathSeparator)) {
+		return "", &os.PathError{Op: "rooted", Path: name, Err: os.ErrInvalid}
+	}
+	return joined, nil
+}
+
+func (f *BasicFilesystem) Mkdir(name string, perm os.FileMode) error {
+	rn, err := f.rooted(name)
+	if err != nil {
+		return err
+	}
+	return os.Mkdir(rn, perm)
+}
+
+func (f *BasicFilesystem) MkdirAll(name string, perm os.FileMode) error {
+	rn, err := f.rooted(name)
+	if err != nil {
+		return err
+	}
+	return os.MkdirAll(rn, perm)
+}
+
+func (f *BasicFilesystem) Open(name string) (File, error) {
+	rn, err := f.rooted(name)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(rn)
+}
+
+func (f *BasicFilesystem) Create(name string) (File, error) {
+	rn, err := f.rooted(name)
+	if err != nil {
+		return nil, err
+	}
+	return os.Create(rn)
+}
+
+func (f *BasicFilesystem) Stat(name string) (os.FileInfo, error) {
+	rn, err := f.rooted(name)
+	if err != nil {
+		return nil, err
+	}
+	return os.Stat(rn)
+}
+
+func (f *BasicFilesystem) Lstat(name string) (os.FileInfo, error) {
+	rn, err := f.rooted(name)
+	if err != nil {
+		return nil, err
+	}
+	return os.Lstat(rn)
+}
+
+func (f *BasicFilesystem) Remove(name string) error {
+	rn, err := f.rooted(name)
+	if err != nil {
+		return err
+	}
+	return os.Remove(rn)
+}
+
+func (f *BasicFilesystem) RemoveAll(name string) error {
+	rn, err := f.rooted(name)
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(rn)
+}
+
+func (f *BasicFilesystem) Rename(oldname, newname string) error {
+	on, err := f.rooted(oldname)
+	if err != nil {
+		return err
+	}
+	nn, err := f.rooted(newname)
+	if err != nil {
+		return err
+	}
+	return os.Rename(on, nn)
+}
+
+func (f *BasicFilesystem) Type() FilesystemType {
+	return FilesystemTypeBasic
+}
+
+func (f *BasicFilesystem) URI() string {
+	return f.root
+}
@@ -0,0 +1,414 @@
+// Copyright (C) 2016 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+//go:build (!solaris && !darwin) || (solaris && cgo) || (darwin && cgo)
+// +build !solaris,!darwin solaris,cgo darwin,cgo
+
+package fs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/zillode/notify"
+)
+
+// backendBuffer is the size of the channel used to receive events from the
+// notify backend. It's a var (not a const) so that tests can shrink it to
+// provoke overflow without waiting for 500+ file operations.
+var backendBuffer = 500
+
+// Op is a bitmask describing what kind of change a watch Event represents.
+// It mirrors fsnotify's Op so that the same mental model (and the same
+// Op.Has/Op.String idioms) applies here.
+type Op uint32
+
+const (
+	Create Op = 1 << iota
+	Write
+	Rename
+	Remove
+	Chmod
+)
+
+// Has reports whether op contains all the bits set in test.
+func (op Op) Has(test Op) bool {
+	return op&test == test
+}
+
+// opNames lists the Op bits in a fixed order so String is deterministic;
+// ranging over a map here would print the set bits in random order.
+var opNames = []struct {
+	bit  Op
+	name string
+}{
+	{Create, "CREATE"},
+	{Write, "WRITE"},
+	{Rename, "RENAME"},
+	{Remove, "REMOVE"},
+	{Chmod, "CHMOD"},
+}
+
+func (op Op) String() string {
+	var names []string
+	for _, o := range opNames {
+		if op.Has(o.bit) {
+			names = append(names, o.name)
+		}
+	}
+	if len(names) == 0 {
+		return ""
+	}
+	return strings.Join(names, "|")
+}
+
+// EventType is kept as an alias for callers that still spell Event's Op
+// field's type as EventType.
+type EventType = Op
+
+// IsRemove reports whether op includes Remove. An Event.Op carries every
+// bit the backend reported (see opFromNotify), and with coalescing the
+// merged bits of a burst, so it can't be compared for equality against a
+// single Op; callers that only care about removal vs. everything else
+// should use this instead.
+func (op Op) IsRemove() bool {
+	return op.Has(Remove)
+}
+
+// Event is sent on the channel returned by Filesystem.Watch whenever
+// something changes under the watched path. Name is relative to the
+// filesystem root, the same as the argument Watch was called with.
+//
+// Err is set instead of Op when the watch itself hit trouble rather than
+// observing a file system change; such events carry the name Watch was
+// called with as Name. Use errors.Is against ErrWatchEventOverflow and
+// ErrWatchClosed to distinguish the cases.
+type Event struct {
+	Name string
+	Op   Op
+	Err  error
+}
+
+// Has reports whether the event's Op contains all the bits set in op, e.g.
+// ev.Has(Rename) or ev.Has(Create|Write).
+func (e Event) Has(op Op) bool {
+	return e.Op.Has(op)
+}
+
+// opFromNotify translates a backend event into our Op bitmask. The
+// zillode/notify backend already normalises platform-specific signals
+// (inotify's IN_CREATE/IN_MOVED_TO, kqueue's NOTE_WRITE, ReadDirectoryChangesW's
+// FILE_ACTION_*, ...) into its own Create/Write/Rename/Remove constants, so
+// there's no per-platform branching needed here beyond the catch-all: any
+// backend event that isn't one of those four is an attribute change
+// (IN_ATTRIB, NOTE_ATTRIB, FILE_ACTION_MODIFIED without a write, ...).
+func opFromNotify(ev notify.Event) Op {
+	var op Op
+	if ev&notify.Create != 0 {
+		op |= Create
+	}
+	if ev&notify.Write != 0 {
+		op |= Write
+	}
+	if ev&notify.Rename != 0 {
+		op |= Rename
+	}
+	if ev&notify.Remove != 0 {
+		op |= Remove
+	}
+	if op == 0 {
+		op = Chmod
+	}
+	return op
+}
+
+// WatchOptions customises the behaviour of Filesystem.Watch beyond the
+// plain "tell me what changed" default (the zero value).
+type WatchOptions struct {
+	// Coalesce, when non-zero, delivers the first event for a path at once
+	// and merges further changes to the same path that follow within this
+	// long of each other (e.g. the Write after a Create) into a single
+	// follow-up event, instead of delivering each one as it's observed.
+	Coalesce time.Duration
+}
+
+func (f *BasicFilesystem) Watch(name string, ignore Matcher, ctx context.Context, ignorePerms bool, opts WatchOptions) (<-chan Event, error) {
+	absName, err := f.rooted(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := os.Lstat(absName); err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("watching %s: %w", name, ErrWatchNotExist)
+		}
+		return nil, err
+	}
+
+	backendChan := make(chan notify.EventInfo, backendBuffer)
+
+	if err := notify.Watch(filepath.Join(absName, "..."), backendChan, notify.All); err != nil {
+		notify.Stop(backendChan)
+		return nil, err
+	}
+
+	outChan := make(chan Event)
+	rawChan := outChan
+	if opts.Coalesce > 0 {
+		rawChan = make(chan Event)
+		go coalesceLoop(name, rawChan, outChan, opts.Coalesce, ctx)
+	}
+
+	go f.watchLoop(name, absName, backendChan, rawChan, ignore, ctx)
+
+	return outChan, nil
+}
+
+// watchLoop reads raw backend events for the subtree rooted at absRoot,
+// filters and translates them into Events relative to name, and forwards
+// them on outChan until ctx is cancelled.
+func (f *BasicFilesystem) watchLoop(name string, absRoot string, backendChan chan notify.EventInfo, outChan chan<- Event, ignore Matcher, ctx context.Context) {
+	defer notify.Stop(backendChan)
+
+	for {
+		// If the backend couldn't keep up and its buffer is full, we've
+		// already lost events and have no way to know which. Drain what's
+		// left, report the overflow and let the caller fall back to a
+		// full scan rather than act on a partial, possibly stale, picture.
+		if len(backendChan) == backendBuffer {
+		drain:
+			for {
+				select {
+				case <-backendChan:
+				default:
+					break drain
+				}
+			}
+			select {
+			case outChan <- Event{Name: name, Err: ErrWatchEventOverflow}:
+			case <-ctx.Done():
+				return
+			}
+			continue
+		}
+
+		select {
+		case ev := <-backendChan:
+			absPath := ev.Path()
+			if absPath != absRoot && !strings.HasPrefix(absPath, absRoot+string(os.PathSeparator)) {
+				panic(fmt.Sprintf("watch for %s received event for unrelated path %s", absRoot, absPath))
+			}
+
+			rel, err := filepath.Rel(absRoot, absPath)
+			if err != nil {
+				panic(err)
+			}
+			relName := filepath.Join(name, rel)
+
+			if ignore.ShouldIgnore(relName) {
+				continue
+			}
+
+			select {
+			case outChan <- Event{Name: relName, Op: opFromNotify(ev.Event())}:
+			case <-ctx.Done():
+				return
+			}
+
+		case <-ctx.Done():
+			// Best effort: let a caller blocked reading outChan know why
+			// it's about to go silent. Never worth blocking for, since
+			// nothing guarantees anyone is still listening.
+			select {
+			case outChan <- Event{Name: name, Err: ErrWatchClosed}:
+			default:
+			}
+			return
+		}
+	}
+}
+
+// coalescePending tracks the merged Op for a path that has fired its
+// leading-edge event and is now within its debounce window. op accumulates
+// every bit seen for the path, including the one already delivered by the
+// leading-edge send; sent records what that leading-edge event carried, so
+// the trailing-edge send can tell a genuine duplicate (op == sent, nothing
+// new to report) from a burst that picked up additional bits (e.g. the
+// Write following a Create) and needs a follow-up event.
+type coalescePending struct {
+	op, sent Op
+	timer    *time.Timer
+}
+
+// coalesceLoop sits between watchLoop and the caller when Coalesce is
+// enabled. The first event for a path is forwarded immediately (leading
+// edge), so callers still see changes promptly; any further events for the
+// same path that arrive before window has elapsed since the last one are
+// merged and delivered as a single follow-up event once things go quiet
+// (trailing edge), rather than one event per write. No follow-up is sent
+// when the merged events added no Op bits beyond the leading event's.
+// Errors from watchLoop
+// (overflow, closed) always bypass coalescing.
+//
+// The map is capped at 4*backendBuffer entries: a watch root under enough
+// sustained churn across that many distinct paths to fill it is cheaper to
+// report as a single overflow and let the caller fall back to a full scan
+// than to keep tracking indefinitely. root is the name Watch was called
+// with, used so that overflow, like watchLoop's own, is reported at the
+// watch root rather than whichever path happened to trip the cap.
+func coalesceLoop(root string, in <-chan Event, out chan<- Event, window time.Duration, ctx context.Context) {
+	pending := make(map[string]*coalescePending)
+	fired := make(chan string)
+
+	stopAll := func() {
+		for _, p := range pending {
+			p.timer.Stop()
+		}
+		pending = make(map[string]*coalescePending)
+	}
+	defer stopAll()
+
+	send := func(ev Event) bool {
+		select {
+		case out <- ev:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+
+	for {
+		select {
+		case ev, ok := <-in:
+			if !ok {
+				return
+			}
+
+			if ev.Err != nil {
+				if !send(ev) {
+					return
+				}
+				if errors.Is(ev.Err, ErrWatchClosed) {
+					return
+				}
+				continue
+			}
+
+			if p, ok := pending[ev.Name]; ok {
+				p.op |= ev.Op
+				p.timer.Reset(window)
+				continue
+			}
+
+			if len(pending) >= 4*backendBuffer {
+				stopAll()
+				if !send(Event{Name: root, Err: ErrWatchEventOverflow}) {
+					return
+				}
+				continue
+			}
+
+			if !send(ev) {
+				return
+			}
+			name := ev.Name
+			pending[name] = &coalescePending{op: ev.Op, sent: ev.Op, timer: time.AfterFunc(window, func() {
+				select {
+				case fired <- name:
+				case <-ctx.Done():
+				}
+			})}
+
+		case name := <-fired:
+			p, ok := pending[name]
+			if !ok {
+				continue
+			}
+			delete(pending, name)
+			if p.op&^p.sent != 0 {
+				if !send(Event{Name: name, Op: p.op}) {
+					return
+				}
+			}
+
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// WatchFile watches a single regular file for modifications, renames-away
+// and deletions. It returns ErrWatchNotExist immediately if name does not
+// exist at call time.
+//
+// Internally this is a non-recursive watch on the parent directory with a
+// path-equality filter, rather than a dedicated recursive watch for a
+// single file as Watch sets up for a whole folder.
+func (f *BasicFilesystem) WatchFile(name string, ctx context.Context) (<-chan Event, error) {
+	absName, err := f.rooted(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := os.Lstat(absName); err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("watching %s: %w", name, ErrWatchNotExist)
+		}
+		return nil, err
+	}
+
+	absParent := filepath.Dir(absName)
+	backendChan := make(chan notify.EventInfo, backendBuffer)
+	if err := notify.Watch(absParent, backendChan, notify.All); err != nil {
+		notify.Stop(backendChan)
+		return nil, err
+	}
+
+	outChan := make(chan Event)
+	go f.watchFileLoop(name, absName, backendChan, outChan, ctx)
+
+	return outChan, nil
+}
+
+// watchFileLoop filters absParent's event stream down to absName alone,
+// translating backend events to Op the same way watchLoop does.
+//
+// A write-then-rename-over-target atomic save (the pattern editors like
+// vim use) replaces the watched name's inode, but the watch itself is on
+// the parent directory, not on that inode: the directory's own inode is
+// untouched by a child being renamed over, so the existing notify.Watch on
+// absParent keeps reporting events for absName across the replace with no
+// extra handling needed here.
+func (f *BasicFilesystem) watchFileLoop(name string, absName string, backendChan chan notify.EventInfo, outChan chan<- Event, ctx context.Context) {
+	defer notify.Stop(backendChan)
+
+	for {
+		select {
+		case ev := <-backendChan:
+			if ev.Path() != absName {
+				continue
+			}
+
+			select {
+			case outChan <- Event{Name: name, Op: opFromNotify(ev.Event())}:
+			case <-ctx.Done():
+				return
+			}
+
+		case <-ctx.Done():
+			select {
+			case outChan <- Event{Name: name, Err: ErrWatchClosed}:
+			default:
+			}
+			return
+		}
+	}
+}
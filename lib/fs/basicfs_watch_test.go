@@ -4,12 +4,14 @@
 // License, v. 2.0. If a copy of the MPL was not distributed with this file,
 // You can obtain one at http://mozilla.org/MPL/2.0/.
 
+//go:build (!solaris && !darwin) || (solaris && cgo) || (darwin && cgo)
 // +build !solaris,!darwin solaris,cgo darwin,cgo
 
 package fs
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -65,10 +67,10 @@ func TestWatchIgnore(t *testing.T) {
 	}
 
 	expectedEvents := []Event{
-		{file, NonRemove},
+		{Name: file, Op: Create},
 	}
 	allowedEvents := []Event{
-		{name, NonRemove},
+		{Name: name, Op: Create},
 	}
 
 	testScenario(t, name, testCase, expectedEvents, allowedEvents, ignored)
@@ -84,18 +86,18 @@ func TestWatchRename(t *testing.T) {
 		renameTestFile(name, old, new)
 	}
 
-	destEvent := Event{new, Remove}
+	destEvent := Event{Name: new, Op: Rename}
 	// Only on these platforms the removed file can be differentiated from
 	// the created file during renaming
 	if runtime.GOOS == "windows" || runtime.GOOS == "linux" || runtime.GOOS == "solaris" {
-		destEvent = Event{new, NonRemove}
+		destEvent = Event{Name: new, Op: Create}
 	}
 	expectedEvents := []Event{
-		{old, Remove},
+		{Name: old, Op: Rename},
 		destEvent,
 	}
 	allowedEvents := []Event{
-		{name, NonRemove},
+		{Name: name, Op: Create},
 	}
 
 	// set the "allow others" flag because we might get the create of
@@ -154,27 +156,239 @@ func TestWatchSubpath(t *testing.T) {
 	cancel()
 }
 
-// TestWatchOverflow checks that an event at the root is sent when maxFiles is reached
+// TestWatchOverflow checks that ErrWatchEventOverflow is reported on the
+// event channel when the backend can't keep up, instead of relying on the
+// caller to notice a magic "." root event.
 func TestWatchOverflow(t *testing.T) {
 	name := "overflow"
-
-	expectedEvents := []Event{
-		{".", NonRemove},
+	if err := testFs.MkdirAll(name, 0755); err != nil {
+		t.Fatal(err)
 	}
+	defer testFs.RemoveAll(name)
 
-	allowedEvents := []Event{
-		{name, NonRemove},
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	eventChan, err := testFs.Watch(name, fakeMatcher{}, ctx, false, WatchOptions{})
+	if err != nil {
+		t.Fatal(err)
 	}
 
-	testCase := func() {
+	go func() {
 		for i := 0; i < 5*backendBuffer; i++ {
-			file := "file" + strconv.Itoa(i)
-			createTestFile(name, file)
-			allowedEvents = append(allowedEvents, Event{file, NonRemove})
+			createTestFile(name, "file"+strconv.Itoa(i))
+		}
+	}()
+
+	timeout := time.NewTimer(time.Minute)
+	for {
+		select {
+		case <-timeout.C:
+			t.Fatal("Timed out before receiving the overflow error")
+		case ev := <-eventChan:
+			if errors.Is(ev.Err, ErrWatchEventOverflow) {
+				return
+			}
 		}
 	}
+}
 
-	testScenario(t, name, testCase, expectedEvents, allowedEvents, "")
+// TestWatchCoalesce checks that a burst of writes to the same file within
+// the coalesce window is merged into a handful of events rather than one
+// per write.
+func TestWatchCoalesce(t *testing.T) {
+	name := "coalesce"
+	if err := testFs.MkdirAll(name, 0755); err != nil {
+		t.Fatal(err)
+	}
+	defer testFs.RemoveAll(name)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	const window = 200 * time.Millisecond
+	eventChan, err := testFs.Watch(name, fakeMatcher{}, ctx, false, WatchOptions{Coalesce: window})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file := createTestFile(name, "churn")
+
+	const writes = 20
+	go func() {
+		for i := 0; i < writes; i++ {
+			writeTestFile(name, file)
+			sleepMs(1)
+		}
+	}()
+
+	received := 0
+	timeout := time.NewTimer(time.Minute)
+	quiet := time.NewTimer(3 * window)
+	for {
+		select {
+		case <-timeout.C:
+			t.Fatal("Timed out waiting for coalesced events")
+		case <-quiet.C:
+			if received == 0 {
+				t.Fatal("Expected at least one coalesced event")
+			}
+			if received >= writes {
+				t.Errorf("Expected coalescing to merge %d writes into fewer events, got %d", writes, received)
+			}
+			return
+		case <-eventChan:
+			received++
+			if !quiet.Stop() {
+				select {
+				case <-quiet.C:
+				default:
+				}
+			}
+			quiet.Reset(3 * window)
+		}
+	}
+}
+
+// TestWatchCoalesceMerge checks that a Create immediately followed by a
+// Write to the same file, both within the coalesce window, are merged into
+// a single trailing event carrying both bits, and that nothing further is
+// delivered for the burst after that merged event.
+func TestWatchCoalesceMerge(t *testing.T) {
+	name := "coalescemerge"
+	if err := testFs.MkdirAll(name, 0755); err != nil {
+		t.Fatal(err)
+	}
+	defer testFs.RemoveAll(name)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	const window = 200 * time.Millisecond
+	eventChan, err := testFs.Watch(name, fakeMatcher{}, ctx, false, WatchOptions{Coalesce: window})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file := "burst"
+	createTestFile(name, file)
+	joined := filepath.Join(name, file)
+	writeTestFile(name, file)
+
+	var events []Event
+	timeout := time.NewTimer(time.Minute)
+	for len(events) < 2 {
+		select {
+		case <-timeout.C:
+			t.Fatalf("Timed out waiting for the Create+Write burst to be delivered, got %v", events)
+		case ev := <-eventChan:
+			if ev.Name == joined {
+				events = append(events, ev)
+			}
+		}
+	}
+
+	if !events[0].Has(Create) {
+		t.Errorf("Expected the leading event to carry Create, got %v", events[0].Op)
+	}
+	if !events[1].Has(Create) || !events[1].Has(Write) {
+		t.Errorf("Expected the merged follow-up event to carry both Create and Write, got %v", events[1].Op)
+	}
+
+	// The file isn't touched again, so once the merged event is delivered
+	// the stream must stay quiet.
+	select {
+	case ev := <-eventChan:
+		t.Fatalf("Expected no further events for %s, got %v", joined, ev)
+	case <-time.After(3 * window):
+	}
+}
+
+// TestWatchFile checks that WatchFile reports ErrWatchNotExist up front for
+// a missing file, and otherwise reports changes to the single watched file.
+func TestWatchFile(t *testing.T) {
+	name := "watchfile"
+	if err := testFs.MkdirAll(name, 0755); err != nil {
+		t.Fatal(err)
+	}
+	defer testFs.RemoveAll(name)
+
+	if _, err := testFs.WatchFile(filepath.Join(name, "nonexistent"), context.Background()); !errors.Is(err, ErrWatchNotExist) {
+		t.Fatalf("Expected ErrWatchNotExist for a missing file, got %v", err)
+	}
+
+	file := createTestFile(name, "single")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	eventChan, err := testFs.WatchFile(filepath.Join(name, file), ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writeTestFile(name, file)
+
+	timeout := time.NewTimer(10 * time.Second)
+	select {
+	case <-timeout.C:
+		t.Fatal("Timed out before receiving an event for the watched file")
+	case ev := <-eventChan:
+		if ev.Name != filepath.Join(name, file) {
+			t.Errorf("Unexpected event name %v", ev.Name)
+		}
+	}
+}
+
+// TestWatchFileAtomicReplace checks that a watched file keeps being
+// tracked across a write-then-rename-over-target atomic save, the pattern
+// editors such as vim use.
+func TestWatchFileAtomicReplace(t *testing.T) {
+	name := "watchfileatomic"
+	if err := testFs.MkdirAll(name, 0755); err != nil {
+		t.Fatal(err)
+	}
+	defer testFs.RemoveAll(name)
+
+	file := createTestFile(name, "target")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	eventChan, err := testFs.WatchFile(filepath.Join(name, file), ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmp := createTestFile(name, "target.tmp")
+	renameTestFile(name, tmp, file)
+
+	timeout := time.NewTimer(10 * time.Second)
+replaceLoop:
+	for {
+		select {
+		case <-timeout.C:
+			t.Fatal("Timed out before observing the atomic replace")
+		case ev := <-eventChan:
+			if ev.Name == filepath.Join(name, file) {
+				break replaceLoop
+			}
+		}
+	}
+
+	// The replace must not have left the watch dead: a write to the new
+	// inode at the same name should still be delivered.
+	writeTestFile(name, file)
+
+	timeout = time.NewTimer(10 * time.Second)
+	select {
+	case <-timeout.C:
+		t.Fatal("Timed out waiting for an event after the atomic replace")
+	case ev := <-eventChan:
+		if ev.Name != filepath.Join(name, file) {
+			t.Errorf("Unexpected event name %v", ev.Name)
+		}
+	}
 }
 
 // path relative to folder root, also creates parent dirs if necessary
@@ -191,6 +405,20 @@ func createTestFile(name string, file string) string {
 	return file
 }
 
+// writeTestFile truncates an already-existing test file and writes to it,
+// to provoke a Write event on a file that is already there.
+func writeTestFile(name string, file string) {
+	joined := filepath.Join(name, file)
+	handle, err := testFs.Create(joined)
+	if err != nil {
+		panic(fmt.Sprintf("Failed to write test file %s: %s", joined, err))
+	}
+	if _, err := handle.Write([]byte("x")); err != nil {
+		panic(fmt.Sprintf("Failed to write test file %s: %s", joined, err))
+	}
+	handle.Close()
+}
+
 func renameTestFile(name string, old string, new string) {
 	old = filepath.Join(name, old)
 	new = filepath.Join(name, new)
@@ -216,7 +444,9 @@ func testScenario(t *testing.T, name string, testCase func(), expectedEvents, al
 		ignored = filepath.Join(name, ignored)
 	}
 
-	eventChan, err := testFs.Watch(name, fakeMatcher{ignored}, ctx, false)
+	// Coalesce a little so that the backend occasionally sending the
+	// same event twice in a row doesn't require any special-casing here.
+	eventChan, err := testFs.Watch(name, fakeMatcher{ignored}, ctx, false, WatchOptions{Coalesce: 20 * time.Millisecond})
 	if err != nil {
 		panic(err)
 	}
@@ -241,7 +471,6 @@ func testWatchOutput(t *testing.T, name string, in <-chan Event, expectedEvents,
 	}
 
 	var received Event
-	var last Event
 	for {
 		if len(expected) == 0 {
 			cancel()
@@ -254,11 +483,6 @@ func testWatchOutput(t *testing.T, name string, in <-chan Event, expectedEvents,
 		case received = <-in:
 		}
 
-		// apparently the backend sometimes sends repeat events
-		if last == received {
-			continue
-		}
-
 		if _, ok := expected[received]; !ok {
 			if len(allowedEvents) > 0 {
 				sleepMs(100) // To facilitate overflow
@@ -269,7 +493,6 @@ func testWatchOutput(t *testing.T, name string, in <-chan Event, expectedEvents,
 			return
 		}
 		delete(expected, received)
-		last = received
 	}
 }
 
@@ -0,0 +1,99 @@
+// Copyright (C) 2016 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package fs
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+)
+
+// The Filesystem interface abstracts access to the file system.
+type Filesystem interface {
+	Mkdir(name string, perm os.FileMode) error
+	MkdirAll(name string, perm os.FileMode) error
+	Open(name string) (File, error)
+	Create(name string) (File, error)
+	Stat(name string) (os.FileInfo, error)
+	Lstat(name string) (os.FileInfo, error)
+	Remove(name string) error
+	RemoveAll(name string) error
+	Rename(oldname, newname string) error
+	Watch(name string, ignore Matcher, ctx context.Context, ignorePerms bool, opts WatchOptions) (<-chan Event, error)
+	WatchFile(name string, ctx context.Context) (<-chan Event, error)
+	Type() FilesystemType
+	URI() string
+}
+
+// File represents an open file descriptor, analogous to *os.File.
+type File interface {
+	io.Reader
+	io.Writer
+	io.Closer
+	Name() string
+}
+
+// Matcher is satisfied by the ignore patterns used to filter Watch events.
+// Implementations report whether a given path (relative to the watched
+// folder root) should be excluded from the event stream.
+type Matcher interface {
+	ShouldIgnore(name string) bool
+}
+
+// FilesystemType identifies which Filesystem implementation a given root
+// should be backed by.
+type FilesystemType int
+
+const (
+	FilesystemTypeBasic FilesystemType = iota
+)
+
+func (t FilesystemType) String() string {
+	switch t {
+	case FilesystemTypeBasic:
+		return "basic"
+	default:
+		return "unknown"
+	}
+}
+
+// NewFilesystem creates a Filesystem of the given type, rooted at uri.
+func NewFilesystem(fsType FilesystemType, uri string) Filesystem {
+	switch fsType {
+	case FilesystemTypeBasic:
+		return newBasicFilesystem(uri)
+	default:
+		return newBasicFilesystem(uri)
+	}
+}
+
+// Sentinel errors returned by Watch and the events it produces, mirroring
+// the ones fsnotify exposes (ErrEventOverflow, ErrNonExistentWatch) so
+// callers can test for them with errors.Is instead of pattern-matching on
+// synthetic events.
+var (
+	// ErrWatchEventOverflow is reported when Watch's buffer of backend
+	// events (backendBuffer entries) filled up faster than we could
+	// drain it, or, with WatchOptions.Coalesce set, when coalescing is
+	// tracking more pending paths than its cap. Backend-specific
+	// overflow signals such as inotify's IN_Q_OVERFLOW are not
+	// inspected. Callers should treat this as "something changed
+	// somewhere under the watch root" and fall back to a full scan.
+	ErrWatchEventOverflow = errors.New("fs: watch event queue overflowed")
+
+	// ErrWatchNotExist is reported up front when the path passed to
+	// Watch or WatchFile does not exist. A path removed after the watch
+	// is established is not reported through this error; it comes
+	// through the event stream as a normal Event with Op.Has(Remove),
+	// the same as any other change.
+	ErrWatchNotExist = errors.New("fs: watched path does not exist")
+
+	// ErrWatchClosed is reported when the watch was torn down via
+	// context cancellation.
+	ErrWatchClosed = errors.New("fs: watch closed")
+)